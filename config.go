@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// WorkflowCriteria descreve os critérios de roteamento de um workflow. Além
+// da igualdade simples usada antes (payment_type + currency), suporta
+// qualquer par chave/valor de Equals, faixas numéricas em Amount e uma
+// whitelist de CardBrand — o suficiente para rotas como Papara ou Sodexo
+// (análogas ao enum PaymentProvider do Craftgate) sem alterar código.
+type WorkflowCriteria struct {
+	Equals     map[string]string `yaml:"equals,omitempty"`
+	AmountMin  *float64          `yaml:"amount_min,omitempty"`
+	AmountMax  *float64          `yaml:"amount_max,omitempty"`
+	CardBrands []string          `yaml:"card_brands,omitempty"`
+}
+
+// Matches reporta se order satisfaz todos os critérios configurados.
+func (c WorkflowCriteria) Matches(order Order) bool {
+	for key, want := range c.Equals {
+		if orderFieldValue(order, key) != want {
+			return false
+		}
+	}
+	if c.AmountMin != nil && order.Amount < *c.AmountMin {
+		return false
+	}
+	if c.AmountMax != nil && order.Amount > *c.AmountMax {
+		return false
+	}
+	if len(c.CardBrands) > 0 && !containsString(c.CardBrands, order.CardBrand) {
+		return false
+	}
+	return true
+}
+
+// orderFieldValue expõe os campos do Order pesquisáveis em Criteria.Equals.
+// "payment_type" permanece fixo em "credit_card" até o Order ganhar um campo
+// próprio de forma de pagamento.
+func orderFieldValue(order Order, field string) string {
+	switch field {
+	case "payment_type":
+		return "credit_card"
+	case "currency":
+		return order.Currency
+	case "card_brand":
+		return order.CardBrand
+	case "customer_id":
+		return order.CustomerID
+	default:
+		return ""
+	}
+}
+
+func containsString(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+// WorkflowConfigEntry é a representação declarativa de um Workflow tal como
+// carregada do arquivo de configuração. Priority resolve o empate quando
+// mais de um critério casa com o mesmo pedido: o menor valor vence primeiro,
+// tornando o loop de seleção determinístico.
+type WorkflowConfigEntry struct {
+	WorkflowID string           `yaml:"workflow_id"`
+	Priority   int              `yaml:"priority"`
+	Criteria   WorkflowCriteria `yaml:"criteria"`
+	Steps      []WorkflowStep   `yaml:"steps"`
+}
+
+// WorkflowConfig é o documento raiz do arquivo de workflows.
+type WorkflowConfig struct {
+	Workflows []WorkflowConfigEntry `yaml:"workflows"`
+}
+
+// defaultWorkflowConfig preserva o comportamento anterior (dois workflows
+// fixos) como fallback caso nenhum arquivo de configuração seja encontrado.
+var defaultWorkflowConfig = WorkflowConfig{
+	Workflows: []WorkflowConfigEntry{
+		{
+			WorkflowID: "wf-payment-dcc-proposal",
+			Priority:   10,
+			Criteria:   WorkflowCriteria{Equals: map[string]string{"payment_type": "credit_card", "currency": "USD"}},
+			Steps: []WorkflowStep{
+				{StepID: "dcc_proposal", Service: "PBC_DCC", Status: "pending"},
+				{StepID: "payment_processing", Service: "PBC_Payment", Status: "pending", CompensateService: "PBC_Refund"},
+			},
+		},
+		{
+			WorkflowID: "wf-payment-generic",
+			Priority:   20,
+			Criteria:   WorkflowCriteria{Equals: map[string]string{"payment_type": "credit_card", "currency": "BRL"}},
+			Steps: []WorkflowStep{
+				{StepID: "payment_processing", Service: "PBC_Payment", Status: "pending", CompensateService: "PBC_Refund"},
+			},
+		},
+	},
+}
+
+// loadWorkflowConfig lê path e decide o parser pela extensão: ".ini" usa o
+// formato plano do c2ec, qualquer outra extensão (".yaml"/".yml" por padrão)
+// usa YAML.
+func loadWorkflowConfig(path string) (*WorkflowConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("lendo %s: %w", path, err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".ini") {
+		return parseWorkflowConfigINI(data)
+	}
+	return parseWorkflowConfigYAML(data)
+}
+
+func parseWorkflowConfigYAML(data []byte) (*WorkflowConfig, error) {
+	var cfg WorkflowConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parseando YAML: %w", err)
+	}
+	return &cfg, nil
+}
+
+// parseWorkflowConfigINI lê o formato plano usado para operações que
+// preferem INI a YAML. Cada workflow é uma seção [workflow "id"]; os passos
+// são uma lista "step_id:service" separada por vírgula.
+//
+//	[workflow "wf-payment-generic"]
+//	priority = 20
+//	equals.currency = BRL
+//	steps = payment_processing:PBC_Payment:PBC_Refund
+func parseWorkflowConfigINI(data []byte) (*WorkflowConfig, error) {
+	file, err := ini.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("parseando INI: %w", err)
+	}
+
+	var cfg WorkflowConfig
+	for _, section := range file.Sections() {
+		if !strings.HasPrefix(section.Name(), "workflow ") {
+			continue
+		}
+		workflowID := strings.Trim(strings.TrimPrefix(section.Name(), "workflow "), `"`)
+
+		entry := WorkflowConfigEntry{
+			WorkflowID: workflowID,
+			Priority:   section.Key("priority").MustInt(100),
+			Criteria:   WorkflowCriteria{Equals: make(map[string]string)},
+		}
+		for _, key := range section.Keys() {
+			if strings.HasPrefix(key.Name(), "equals.") {
+				entry.Criteria.Equals[strings.TrimPrefix(key.Name(), "equals.")] = key.Value()
+			}
+		}
+		if min, err := section.Key("amount_min").Float64(); err == nil {
+			entry.Criteria.AmountMin = &min
+		}
+		if max, err := section.Key("amount_max").Float64(); err == nil {
+			entry.Criteria.AmountMax = &max
+		}
+		if brands := section.Key("card_brands").Strings(","); len(brands) > 0 {
+			entry.Criteria.CardBrands = brands
+		}
+		for _, raw := range section.Key("steps").Strings(",") {
+			parts := strings.Split(raw, ":")
+			step := WorkflowStep{Status: "pending"}
+			if len(parts) > 0 {
+				step.StepID = parts[0]
+			}
+			if len(parts) > 1 {
+				step.Service = parts[1]
+			}
+			if len(parts) > 2 {
+				step.CompensateService = parts[2]
+			}
+			entry.Steps = append(entry.Steps, step)
+		}
+		cfg.Workflows = append(cfg.Workflows, entry)
+	}
+	return &cfg, nil
+}
+
+// configWorkflowDefinitionStore é o WorkflowDefinitionStore carregado a
+// partir de um arquivo YAML/INI. Suporta hot-reload via SIGHUP (ver
+// watchConfigReload) sem reiniciar o processo.
+type configWorkflowDefinitionStore struct {
+	mu      sync.RWMutex
+	path    string
+	entries []WorkflowConfigEntry
+}
+
+// newConfigWorkflowDefinitionStore carrega path; se o arquivo não existir ou
+// falhar o parse, cai de volta para defaultWorkflowConfig para manter a
+// aplicação funcional em um ambiente novo.
+func newConfigWorkflowDefinitionStore(path string) *configWorkflowDefinitionStore {
+	s := &configWorkflowDefinitionStore{path: path}
+	if err := s.Reload(); err != nil {
+		log.Printf("[Config] Falha ao carregar workflows de %s, usando padrão embutido: %v", path, err)
+		s.setEntries(defaultWorkflowConfig.Workflows)
+	}
+	return s
+}
+
+// Reload relê o arquivo de configuração do disco e substitui as definições
+// carregadas atomicamente.
+func (s *configWorkflowDefinitionStore) Reload() error {
+	cfg, err := loadWorkflowConfig(s.path)
+	if err != nil {
+		return err
+	}
+	s.setEntries(cfg.Workflows)
+	log.Printf("[Config] %d workflows carregados de %s", len(cfg.Workflows), s.path)
+	return nil
+}
+
+func (s *configWorkflowDefinitionStore) setEntries(entries []WorkflowConfigEntry) {
+	sorted := append([]WorkflowConfigEntry(nil), entries...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = sorted
+}
+
+func (s *configWorkflowDefinitionStore) Find(ctx context.Context, order Order) (*Workflow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, entry := range s.entries {
+		if !entry.Criteria.Matches(order) {
+			continue
+		}
+		steps := make([]WorkflowStep, len(entry.Steps))
+		copy(steps, entry.Steps)
+		return &Workflow{WorkflowID: entry.WorkflowID, Criteria: entry.Criteria.Equals, Steps: steps}, nil
+	}
+	return nil, ErrNotFound
+}
+
+// FindByID busca um workflow já configurado pelo seu WorkflowID, usado ao
+// reconstruir uma WorkflowInstance persistida a partir do banco.
+func (s *configWorkflowDefinitionStore) FindByID(ctx context.Context, workflowID string) (*Workflow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, entry := range s.entries {
+		if entry.WorkflowID != workflowID {
+			continue
+		}
+		steps := make([]WorkflowStep, len(entry.Steps))
+		copy(steps, entry.Steps)
+		return &Workflow{WorkflowID: entry.WorkflowID, Criteria: entry.Criteria.Equals, Steps: steps}, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *configWorkflowDefinitionStore) All(ctx context.Context) ([]Workflow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := make([]Workflow, len(s.entries))
+	for i, entry := range s.entries {
+		out[i] = Workflow{WorkflowID: entry.WorkflowID, Criteria: entry.Criteria.Equals, Steps: entry.Steps}
+	}
+	return out, nil
+}
+
+// watchConfigReload escuta SIGHUP e recarrega as definições de workflow sem
+// reiniciar o processo, permitindo que operações adicionem novas rotas de
+// PBC apenas editando o arquivo de configuração.
+func watchConfigReload(store *configWorkflowDefinitionStore) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := store.Reload(); err != nil {
+				log.Printf("[Config] SIGHUP recebido, falha ao recarregar workflows: %v", err)
+			} else {
+				log.Println("[Config] SIGHUP recebido, workflows recarregados")
+			}
+		}
+	}()
+}
+
+// adminWorkflowsHandler expõe as definições de workflow atualmente
+// carregadas, para inspeção operacional em /admin/workflows.
+func adminWorkflowsHandler(store *configWorkflowDefinitionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		workflows, _ := store.All(r.Context())
+		json.NewEncoder(w).Encode(workflows)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// IdempotencyTTL define por quanto tempo uma chave de idempotência fica
+// armazenada antes de poder ser reutilizada, seguindo o mesmo padrão dos
+// clientes Go da Increase/Modern Treasury.
+const IdempotencyTTL = 24 * time.Hour
+
+// idempotencyRecord guarda a resposta original associada a uma
+// Idempotency-Key, para que requisições repetidas recebam o mesmo
+// resultado byte a byte em vez de reexecutar o handler.
+type idempotencyRecord struct {
+	BodyHash       string
+	ResponseStatus int
+	ResponseBody   []byte
+	ExpiresAt      time.Time
+}
+
+// IdempotencyCache abstrai o armazenamento das chaves de idempotência. A
+// implementação padrão é em memória; um backend Redis pode ser plugado para
+// que as chaves sobrevivam a um restart assim que o store persistente
+// (ver store.go) estiver em uso.
+type IdempotencyCache interface {
+	// Reserve tenta reservar key com o hash informado. Se a chave ainda não
+	// existir, reserva e retorna (nil, false, nil): o chamador deve
+	// executar o handler e chamar Complete. Se a chave já existir com o
+	// mesmo hash, retorna o registro salvo (record, true, nil). Se existir
+	// com um hash diferente, retorna ErrIdempotencyKeyMismatch.
+	Reserve(ctx context.Context, key, bodyHash string) (record *idempotencyRecord, found bool, err error)
+	Complete(ctx context.Context, key string, status int, body []byte) error
+	// Release libera uma chave reservada sem gravar uma resposta, usado
+	// quando o handler falhou (resposta não 2xx): a chave volta a ficar
+	// livre para que a próxima tentativa rode o handler de novo em vez de
+	// reproduzir a falha pelo resto do IdempotencyTTL.
+	Release(ctx context.Context, key string) error
+	// Sweep remove as chaves expiradas; chamado periodicamente pelo TTL sweeper.
+	Sweep(ctx context.Context, now time.Time) error
+}
+
+// ErrIdempotencyKeyMismatch indica que a mesma Idempotency-Key foi reutilizada
+// com um corpo de requisição diferente.
+var ErrIdempotencyKeyMismatch = &idempotencyError{"Idempotency-Key reutilizada com corpo diferente"}
+
+type idempotencyError struct{ msg string }
+
+func (e *idempotencyError) Error() string { return e.msg }
+
+// reservation representa uma chave de idempotência em andamento: o handler
+// original já começou a rodar mas ainda não chamou Complete. done é fechado
+// quando isso acontece, permitindo que requisições concorrentes aguardem a
+// resposta em vez de disparar o handler de novo.
+type reservation struct {
+	hash string
+	done chan struct{}
+}
+
+// memoryIdempotencyCache é o backend padrão: mantém os registros em memória
+// protegidos por mutex, como os demais stores em memória da aplicação.
+type memoryIdempotencyCache struct {
+	mu      sync.Mutex
+	records map[string]*idempotencyRecord
+	// reserved marca chaves em andamento (handler ainda não concluído),
+	// para que requisições concorrentes com a mesma chave não disparem o
+	// handler duas vezes.
+	reserved map[string]*reservation
+}
+
+func newMemoryIdempotencyCache() *memoryIdempotencyCache {
+	return &memoryIdempotencyCache{
+		records:  make(map[string]*idempotencyRecord),
+		reserved: make(map[string]*reservation),
+	}
+}
+
+func (c *memoryIdempotencyCache) Reserve(ctx context.Context, key, bodyHash string) (*idempotencyRecord, bool, error) {
+	c.mu.Lock()
+
+	if record, ok := c.records[key]; ok {
+		c.mu.Unlock()
+		if record.BodyHash != bodyHash {
+			return nil, false, ErrIdempotencyKeyMismatch
+		}
+		return record, true, nil
+	}
+
+	if res, ok := c.reserved[key]; ok {
+		if res.hash != bodyHash {
+			c.mu.Unlock()
+			return nil, false, ErrIdempotencyKeyMismatch
+		}
+		c.mu.Unlock()
+
+		// Uma requisição concorrente com a mesma chave já está em
+		// andamento: espera o handler original concluir e reproduz a
+		// resposta dele em vez de rodar o handler de novo.
+		select {
+		case <-res.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+
+		c.mu.Lock()
+		record, ok := c.records[key]
+		c.mu.Unlock()
+		if !ok {
+			// A requisição original terminou sem chamar Complete (ex.:
+			// handler abortou antes do fim); deixa esta repetir.
+			return nil, false, nil
+		}
+		return record, true, nil
+	}
+
+	c.reserved[key] = &reservation{hash: bodyHash, done: make(chan struct{})}
+	c.mu.Unlock()
+	return nil, false, nil
+}
+
+func (c *memoryIdempotencyCache) Complete(ctx context.Context, key string, status int, body []byte) error {
+	c.mu.Lock()
+	res, ok := c.reserved[key]
+	var hash string
+	if ok {
+		hash = res.hash
+	}
+	delete(c.reserved, key)
+	c.records[key] = &idempotencyRecord{
+		BodyHash:       hash,
+		ResponseStatus: status,
+		ResponseBody:   body,
+		ExpiresAt:      time.Now().Add(IdempotencyTTL),
+	}
+	c.mu.Unlock()
+
+	if ok {
+		close(res.done)
+	}
+	return nil
+}
+
+func (c *memoryIdempotencyCache) Release(ctx context.Context, key string) error {
+	c.mu.Lock()
+	res, ok := c.reserved[key]
+	delete(c.reserved, key)
+	c.mu.Unlock()
+
+	if ok {
+		close(res.done)
+	}
+	return nil
+}
+
+func (c *memoryIdempotencyCache) Sweep(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, record := range c.records {
+		if now.After(record.ExpiresAt) {
+			delete(c.records, key)
+		}
+	}
+	return nil
+}
+
+// idempotencyCache é o backend usado pelos handlers HTTP. Trocado por um
+// backend Redis (ver idempotency_redis.go) quando REDIS_ADDR estiver
+// definido.
+var idempotencyCache IdempotencyCache = newMemoryIdempotencyCache()
+
+// startIdempotencySweeper dispara Sweep periodicamente para expirar chaves
+// antigas, evitando que o cache cresça sem limite.
+func startIdempotencySweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := idempotencyCache.Sweep(ctx, now); err != nil {
+					log.Printf("[Idempotency] Falha ao expirar chaves: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// withIdempotency envolve um handler de escrita (POST) com a semântica de
+// Idempotency-Key: se o cabeçalho estiver ausente, o handler roda
+// normalmente; se presente, requisições repetidas com o mesmo corpo
+// recebem a resposta original, e corpos divergentes para a mesma chave
+// recebem 409 Conflict. Apenas respostas 2xx são cacheadas e reproduzidas —
+// uma falha transitória (ex.: 500 de erro interno) libera a chave para que
+// a próxima tentativa rode o handler de novo em vez de reproduzir o erro
+// pelo resto do IdempotencyTTL.
+func withIdempotency(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		bodyHash := hashRequestBody(bodyBytes)
+
+		record, found, err := idempotencyCache.Reserve(r.Context(), key, bodyHash)
+		if err == ErrIdempotencyKeyMismatch {
+			http.Error(w, "Idempotency-Key already used with a different request body", http.StatusConflict)
+			return
+		}
+		if found {
+			w.WriteHeader(record.ResponseStatus)
+			w.Write(record.ResponseBody)
+			return
+		}
+
+		// Restaura o corpo para o handler original e captura a resposta
+		// para que possa ser reproduzida em retentativas.
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+
+		for header, values := range recorder.Header() {
+			for _, value := range values {
+				w.Header().Add(header, value)
+			}
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+
+		if recorder.Code >= 200 && recorder.Code < 300 {
+			if err := idempotencyCache.Complete(r.Context(), key, recorder.Code, recorder.Body.Bytes()); err != nil {
+				log.Printf("[Idempotency] Falha ao salvar resposta para chave %s: %v", key, err)
+			}
+			return
+		}
+		if err := idempotencyCache.Release(r.Context(), key); err != nil {
+			log.Printf("[Idempotency] Falha ao liberar chave %s após resposta %d: %v", key, recorder.Code, err)
+		}
+	}
+}
+
+// hashRequestBody calcula o hash usado para detectar reuso de chave com
+// corpo divergente.
+func hashRequestBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
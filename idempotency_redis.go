@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisIdempotencyCache é o backend opcional de idempotência: guarda os
+// registros em Redis com TTL nativo, para que sobrevivam a um restart do
+// processo assim que REDIS_ADDR estiver configurado.
+type redisIdempotencyCache struct {
+	client *redis.Client
+}
+
+func newRedisIdempotencyCache(addr string) *redisIdempotencyCache {
+	return &redisIdempotencyCache{client: redis.NewClient(&redis.Options{Addr: addr})}
+}
+
+func redisKey(key string) string { return "idempotency:" + key }
+
+// idempotencyPollInterval e idempotencyPollTimeout controlam a espera por
+// uma reserva concorrente já em voo no backend Redis: diferente do
+// memoryIdempotencyCache, não há um canal local para notificar quando o
+// handler original conclui, então Reserve faz polling da chave até ela
+// ganhar uma resposta (Complete), ser liberada (Release) ou o timeout
+// vencer — espelhando a mesma garantia de não duplicar chamadas
+// concorrentes que o backend em memória oferece.
+const (
+	idempotencyPollInterval = 50 * time.Millisecond
+	idempotencyPollTimeout  = 10 * time.Second
+)
+
+func (c *redisIdempotencyCache) Reserve(ctx context.Context, key, bodyHash string) (*idempotencyRecord, bool, error) {
+	raw, err := c.client.Get(ctx, redisKey(key)).Bytes()
+	if err == redis.Nil {
+		// SetNX reserva a chave com apenas o hash até o handler concluir e
+		// chamar Complete com a resposta final.
+		placeholder := idempotencyRecord{BodyHash: bodyHash}
+		data, marshalErr := json.Marshal(placeholder)
+		if marshalErr != nil {
+			return nil, false, marshalErr
+		}
+		ok, err := c.client.SetNX(ctx, redisKey(key), data, IdempotencyTTL).Result()
+		if err != nil {
+			return nil, false, fmt.Errorf("reservando chave de idempotência: %w", err)
+		}
+		if ok {
+			return nil, false, nil
+		}
+		// Perdeu a corrida do SetNX para outra requisição concorrente: cai
+		// no mesmo caminho de espera usado para uma reserva já existente.
+		return c.awaitReservation(ctx, key, bodyHash)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("lendo chave de idempotência: %w", err)
+	}
+
+	var record idempotencyRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return nil, false, fmt.Errorf("decodificando chave de idempotência: %w", err)
+	}
+	if record.BodyHash != bodyHash {
+		return nil, false, ErrIdempotencyKeyMismatch
+	}
+	if record.ResponseBody == nil {
+		return c.awaitReservation(ctx, key, bodyHash)
+	}
+	return &record, true, nil
+}
+
+// awaitReservation espera uma reserva em voo (hash já conferido pelo
+// chamador) ganhar uma resposta via Complete. Se a chave for liberada
+// (Release) ou sumir antes disso, retorna (nil, false, nil) para que o
+// chamador rode o handler ele mesmo.
+func (c *redisIdempotencyCache) awaitReservation(ctx context.Context, key, bodyHash string) (*idempotencyRecord, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, idempotencyPollTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(idempotencyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false, nil
+		case <-ticker.C:
+			raw, err := c.client.Get(ctx, redisKey(key)).Bytes()
+			if err == redis.Nil {
+				return nil, false, nil
+			}
+			if err != nil {
+				return nil, false, fmt.Errorf("lendo chave de idempotência: %w", err)
+			}
+			var record idempotencyRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return nil, false, fmt.Errorf("decodificando chave de idempotência: %w", err)
+			}
+			if record.BodyHash != bodyHash {
+				return nil, false, ErrIdempotencyKeyMismatch
+			}
+			if record.ResponseBody != nil {
+				return &record, true, nil
+			}
+		}
+	}
+}
+
+func (c *redisIdempotencyCache) Complete(ctx context.Context, key string, status int, body []byte) error {
+	var bodyHash string
+	if raw, err := c.client.Get(ctx, redisKey(key)).Bytes(); err == nil {
+		var existing idempotencyRecord
+		if json.Unmarshal(raw, &existing) == nil {
+			bodyHash = existing.BodyHash
+		}
+	}
+
+	record := idempotencyRecord{
+		BodyHash:       bodyHash,
+		ResponseStatus: status,
+		ResponseBody:   body,
+		ExpiresAt:      time.Now().Add(IdempotencyTTL),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(ctx, redisKey(key), data, IdempotencyTTL).Err()
+}
+
+// Release remove a reserva sem gravar resposta, liberando a chave para que
+// a próxima tentativa rode o handler de novo em vez de reproduzir uma
+// falha pelo resto do IdempotencyTTL.
+func (c *redisIdempotencyCache) Release(ctx context.Context, key string) error {
+	return c.client.Del(ctx, redisKey(key)).Err()
+}
+
+// Sweep é um no-op no backend Redis: o TTL nativo já expira as chaves.
+func (c *redisIdempotencyCache) Sweep(ctx context.Context, now time.Time) error {
+	return nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"time"
 )
 
 // Order representa um pedido recebido na aplicação de pedidos
@@ -18,13 +21,27 @@ type Order struct {
 	DCCAccepted     bool    `json:"dcc_accepted"`
 	PaymentAmount   float64 `json:"payment_amount"`   // Valor a ser processado
 	PaymentCurrency string  `json:"payment_currency"` // Moeda a ser utilizada no processamento
+	Status          string  `json:"status"`           // pending, completed, failed ou refunded
+	// DCCCallbackURL é o endpoint do cliente para onde a proposta de DCC é
+	// entregue de forma assíncrona (ver webhook.go). Se vazio, a proposta
+	// apenas é logada, preservando o comportamento de ambiente local/dev.
+	DCCCallbackURL string `json:"dcc_callback_url,omitempty"`
 }
 
 // WorkflowStep representa um passo do workflow
 type WorkflowStep struct {
-	StepID  string `json:"step_id"`
-	Service string `json:"service"`
-	Status  string `json:"status"`
+	StepID  string `json:"step_id" yaml:"step_id"`
+	Service string `json:"service" yaml:"service"`
+	Status  string `json:"status" yaml:"status"`
+	// ProviderTimeout limita quanto tempo executeStep espera pelo provedor
+	// associado a Service antes de considerar o passo como falho. Zero usa
+	// o timeout padrão de 5s.
+	ProviderTimeout time.Duration `json:"provider_timeout,omitempty" yaml:"provider_timeout,omitempty"`
+	// CompensateService é o serviço acionado para reverter este passo
+	// (saga pattern) quando um passo posterior falha. Vazio significa que
+	// o passo não tem ação de compensação (ex.: "refund", "freeze_amount",
+	// "unfreeze_amount" encontram seus pares aqui).
+	CompensateService string `json:"compensate_service,omitempty" yaml:"compensate_service,omitempty"`
 }
 
 // Workflow representa um workflow de PBC armazenado no banco
@@ -34,46 +51,41 @@ type Workflow struct {
 	Steps      []WorkflowStep    `json:"steps"`
 }
 
-// Simulação de um banco de dados em memória para workflows
-var workflowsDB = []Workflow{
-	{
-		WorkflowID: "wf-payment-dcc-proposal",
-		Criteria: map[string]string{
-			"payment_type": "credit_card",
-			"currency":     "USD",
-		},
-		Steps: []WorkflowStep{
-			{"dcc_proposal", "PBC_DCC", "pending"},
-			{"payment_processing", "PBC_Payment", "pending"},
-		},
-	},
-	{
-		WorkflowID: "wf-payment-generic",
-		Criteria: map[string]string{
-			"payment_type": "credit_card",
-			"currency":     "BRL",
-		},
-		Steps: []WorkflowStep{
-			{"payment_processing", "PBC_Payment", "pending"},
-		},
-	},
-}
-
-// Mutex para acesso seguro ao banco de pedidos
-var orderMutex sync.Mutex
-var ordersDB = make(map[string]Order)
+// Status possíveis de uma WorkflowInstance. "pending" e "awaiting_dcc" são os
+// estados que a rotina de recuperação na inicialização procura retomar.
+const (
+	InstanceStatusPending     = "pending"
+	InstanceStatusAwaitingDCC = "awaiting_dcc"
+	InstanceStatusCompleted   = "completed"
+	InstanceStatusFailed      = "failed"
+)
 
-// WorkflowInstance guarda o workflow selecionado e o índice do passo atual para um pedido
+// WorkflowInstance guarda o workflow selecionado e o progresso de execução
+// para um pedido. Status e StepIndex são persistidos a cada transição por
+// executeWorkflowSteps, o que permite retomar a instância após um crash.
 type WorkflowInstance struct {
-	Workflow  *Workflow
-	StepIndex int
+	OrderID string
+	// InstanceKey identifica esta instância no WorkflowInstanceStore. Para o
+	// workflow principal de um pedido é igual a OrderID; workflows
+	// sintéticos lançados contra um pedido já existente (ex.: o estorno em
+	// saga.go) usam uma chave própria para não sobrescrever o histórico do
+	// workflow original.
+	InstanceKey string
+	Workflow    *Workflow
+	StepIndex   int
+	Status      string
+	StepHistory []StepRecord
 }
 
-// Mapeia OrderID para a instância do workflow iniciado
-var workflowInstances = make(map[string]*WorkflowInstance)
+// store é o backend de persistência da aplicação. Por padrão usa o backend
+// em memória; se DATABASE_URL estiver definido, main() troca por um
+// postgresStore antes de subir o servidor.
+var store Store
 
 // createOrder recebe um pedido e inicia o workflow correspondente
 func createOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	var order Order
 	err := json.NewDecoder(r.Body).Decode(&order)
 	if err != nil {
@@ -81,68 +93,138 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orderMutex.Lock()
-	order.OrderID = fmt.Sprintf("order-%d", len(ordersDB)+1)
 	// Inicializa os campos de pagamento com os valores originais
 	order.PaymentAmount = order.Amount
 	order.PaymentCurrency = order.Currency
-	ordersDB[order.OrderID] = order
-	orderMutex.Unlock()
+	order.Status = OrderStatusPending
+
+	if err := store.Orders().Create(ctx, &order); err != nil {
+		log.Printf("[Pedidos] Falha ao criar pedido: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
 
 	log.Printf("[Pedidos] Pedido criado: %+v", order)
 
 	// Seleciona o workflow com base nos campos originais do pedido
-	workflow := findWorkflow(order)
-	if workflow == nil {
+	workflow, err := store.Workflows().Find(ctx, order)
+	if err != nil {
 		log.Printf("[Orquestrador] Nenhum workflow encontrado para OrderID: %s", order.OrderID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
 		return
 	}
 
-	// Armazena a instância do workflow para este pedido
-	workflowInstances[order.OrderID] = &WorkflowInstance{
-		Workflow:  workflow,
-		StepIndex: 0,
+	instance := newWorkflowInstance(order.OrderID, workflow)
+	if err := store.Instances().Save(ctx, instance.InstanceKey, instance); err != nil {
+		log.Printf("[Orquestrador] Falha ao persistir instância de workflow: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
 	}
 
 	// Inicia a execução dos passos
-	go executeWorkflowSteps(order, workflowInstances[order.OrderID])
+	go executeWorkflowSteps(context.Background(), order, instance)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 }
 
-// findWorkflow busca o workflow adequado para um pedido com base nos campos originais
-func findWorkflow(order Order) *Workflow {
-	// Utiliza o campo original 'Currency' para selecionar o workflow
-	for _, wf := range workflowsDB {
-		if wf.Criteria["payment_type"] == "credit_card" && wf.Criteria["currency"] == order.Currency {
-			return &wf
-		}
+// newWorkflowInstance cria uma instância pronta para execução, com um
+// StepHistory pré-populado em "pending" para cada passo do workflow.
+func newWorkflowInstance(orderID string, workflow *Workflow) *WorkflowInstance {
+	history := make([]StepRecord, len(workflow.Steps))
+	for i, step := range workflow.Steps {
+		history[i] = StepRecord{StepID: step.StepID, Service: step.Service, Status: "pending"}
+	}
+	return &WorkflowInstance{
+		OrderID:     orderID,
+		InstanceKey: orderID,
+		Workflow:    workflow,
+		StepIndex:   0,
+		Status:      InstanceStatusPending,
+		StepHistory: history,
 	}
-	return nil
 }
 
-// executeWorkflowSteps executa os passos do workflow a partir do índice atual armazenado na instância
-func executeWorkflowSteps(order Order, instance *WorkflowInstance) {
+// executeWorkflowSteps executa os passos do workflow a partir do índice atual
+// armazenado na instância. Cada transição (entrada em um passo, conclusão,
+// ou pausa aguardando callback externo) é persistida dentro de uma
+// transação de banco antes de seguir para o próximo passo, de modo que um
+// crash do processo deixe o estado recuperável. Se um passo falha depois que
+// passos anteriores já completaram, a instância aciona a compensação (saga)
+// desses passos antes de marcar o workflow como falho.
+func executeWorkflowSteps(ctx context.Context, order Order, instance *WorkflowInstance) {
 	for i := instance.StepIndex; i < len(instance.Workflow.Steps); i++ {
 		step := instance.Workflow.Steps[i]
 		log.Printf("[Orquestrador] Executando passo %s com %s para OrderID: %s", step.StepID, step.Service, order.OrderID)
+		instance.StepHistory[i].StartedAt = time.Now()
+
+		if _, err := executeStep(ctx, step, order); err != nil {
+			failStep(ctx, instance, i, order, err)
+			return
+		}
+		instance.Workflow.Steps[i].Status = "completed"
+		instance.StepHistory[i].Status = "completed"
+		instance.StepHistory[i].CompletedAt = time.Now()
 
 		if step.StepID == "dcc_proposal" {
-			// Envia a proposta de DCC e pausa o workflow aguardando resposta do cliente
-			proposeDCC(order)
+			// Pausa o workflow aguardando resposta do cliente ao DCC
 			instance.StepIndex = i + 1
+			instance.Status = InstanceStatusAwaitingDCC
+			if err := store.Instances().Save(ctx, instance.InstanceKey, instance); err != nil {
+				log.Printf("[Orquestrador] Falha ao persistir instância em awaiting_dcc para OrderID: %s: %v", order.OrderID, err)
+			}
 			return
 		}
 
-		if step.Service == "PBC_Payment" {
-			// Processa o pagamento utilizando os valores atualizados para pagamento
-			processPayment(order)
+		instance.StepIndex = i + 1
+		err := store.WithTransaction(ctx, func(txCtx context.Context) error {
+			if err := store.Orders().Update(txCtx, order); err != nil {
+				return err
+			}
+			return store.Instances().Save(txCtx, instance.InstanceKey, instance)
+		})
+		if err != nil {
+			log.Printf("[Orquestrador] Falha ao persistir progresso do passo %s para OrderID: %s: %v", step.StepID, order.OrderID, err)
+			return
 		}
 	}
 
+	instance.Status = InstanceStatusCompleted
+	if instance.Workflow.WorkflowID == "wf-refund" {
+		order.Status = OrderStatusRefunded
+	} else {
+		order.Status = OrderStatusCompleted
+	}
+	if err := store.Orders().Update(ctx, order); err != nil {
+		log.Printf("[Pedidos] Falha ao atualizar status final do pedido %s: %v", order.OrderID, err)
+	}
 	log.Printf("[Orquestrador] Workflow concluído para OrderID: %s", order.OrderID)
-	delete(workflowInstances, order.OrderID)
+	if err := store.Instances().Save(ctx, instance.InstanceKey, instance); err != nil {
+		log.Printf("[Orquestrador] Falha ao persistir instância concluída para OrderID: %s: %v", order.OrderID, err)
+	}
+}
+
+// failStep marca o passo stepIndex como falho na instância, aciona a
+// compensação dos passos anteriores já concluídos e persiste o novo estado.
+func failStep(ctx context.Context, instance *WorkflowInstance, stepIndex int, order Order, err error) {
+	instance.Workflow.Steps[stepIndex].Status = "failed"
+	instance.StepHistory[stepIndex].Status = "failed"
+	instance.StepHistory[stepIndex].CompletedAt = time.Now()
+	instance.Status = InstanceStatusFailed
+	if providerErr, ok := err.(*ProviderError); ok {
+		logProviderFailure(order, providerErr)
+	} else {
+		log.Printf("[Orquestrador] Passo %s falhou para OrderID: %s: %v", instance.Workflow.Steps[stepIndex].StepID, order.OrderID, err)
+	}
+
+	order.Status = OrderStatusFailed
+	if saveErr := store.Orders().Update(ctx, order); saveErr != nil {
+		log.Printf("[Pedidos] Falha ao atualizar status de falha do pedido %s: %v", order.OrderID, saveErr)
+	}
+
+	// compensate já persiste a instância com o resultado da compensação.
+	compensate(ctx, instance, order, stepIndex)
 }
 
 // proposeDCC envia a proposta de conversão de moeda (DCC) ao cliente
@@ -157,43 +239,76 @@ func processPayment(order Order) {
 	log.Printf("[PBC_Payment] Processando pagamento para OrderID: %s, valor: %.2f %s", order.OrderID, order.PaymentAmount, order.PaymentCurrency)
 }
 
-// acceptDCCHandler processa a resposta do cliente à oferta de DCC e retoma o workflow
+// acceptDCCHandler é a contraparte de entrada do webhook assinado de DCC:
+// verifica X-PBC-Signature (com janela de proteção contra replay) e deduplica
+// por X-PBC-Event-Id antes de processar a resposta do cliente e retomar o
+// workflow.
 func acceptDCCHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	signature := r.Header.Get("X-PBC-Signature")
+	if signature == "" {
+		http.Error(w, "Missing X-PBC-Signature", http.StatusUnauthorized)
+		return
+	}
+	if err := verifySignatureHeader(webhookSecret(), signature, body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid signature: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	eventID := r.Header.Get("X-PBC-Event-Id")
+	if eventID != "" && !markEventSeen(eventID) {
+		// Já processado: responde OK para que o remetente pare de retentar.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	var response struct {
 		OrderID     string  `json:"order_id"`
 		Accepted    bool    `json:"accepted"`
 		NewAmount   float64 `json:"new_amount,omitempty"`
 		NewCurrency string  `json:"new_currency,omitempty"`
 	}
-	err := json.NewDecoder(r.Body).Decode(&response)
-	if err != nil {
+	if err := json.Unmarshal(body, &response); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	orderMutex.Lock()
-	order, exists := ordersDB[response.OrderID]
-	if exists {
-		if response.Accepted {
-			log.Printf("[PBC_DCC] Cliente aceitou DCC para OrderID: %s. Novo valor: %f %s",
-				response.OrderID, response.NewAmount, response.NewCurrency)
-			// Atualiza somente os campos de pagamento, mantendo os originais para busca
-			order.PaymentAmount = response.NewAmount
-			order.PaymentCurrency = response.NewCurrency
-			order.DCCAccepted = true
-		} else {
-			log.Printf("[PBC_DCC] Cliente recusou DCC para OrderID: %s. Mantendo valor original: %.2f %s",
-				response.OrderID, order.PaymentAmount, order.PaymentCurrency)
-			order.DCCAccepted = false
-		}
-		ordersDB[response.OrderID] = order
+	order, err := store.Orders().Get(ctx, response.OrderID)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	if response.Accepted {
+		log.Printf("[PBC_DCC] Cliente aceitou DCC para OrderID: %s. Novo valor: %f %s",
+			response.OrderID, response.NewAmount, response.NewCurrency)
+		// Atualiza somente os campos de pagamento, mantendo os originais para busca
+		order.PaymentAmount = response.NewAmount
+		order.PaymentCurrency = response.NewCurrency
+		order.DCCAccepted = true
+	} else {
+		log.Printf("[PBC_DCC] Cliente recusou DCC para OrderID: %s. Mantendo valor original: %.2f %s",
+			response.OrderID, order.PaymentAmount, order.PaymentCurrency)
+		order.DCCAccepted = false
+	}
+	if err := store.Orders().Update(ctx, order); err != nil {
+		log.Printf("[Pedidos] Falha ao atualizar pedido %s após resposta de DCC: %v", response.OrderID, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
 	}
-	orderMutex.Unlock()
 
 	// Retoma o workflow utilizando a instância já armazenada, garantindo que o passo de pagamento seja executado
-	if instance, ok := workflowInstances[response.OrderID]; ok {
+	instance, err := store.Instances().Get(ctx, response.OrderID)
+	if err == nil {
 		log.Printf("[Orquestrador] Retomando workflow para OrderID: %s", response.OrderID)
-		go executeWorkflowSteps(order, instance)
+		go executeWorkflowSteps(context.Background(), order, instance)
 	} else {
 		log.Printf("[Orquestrador] Nenhuma instância de workflow encontrada para OrderID: %s", response.OrderID)
 	}
@@ -201,10 +316,80 @@ func acceptDCCHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// recoverPendingWorkflows é executada na inicialização: busca no store toda
+// instância em "pending" e retoma sua execução a partir do StepIndex
+// persistido, cobrindo o caso de o processo ter sido encerrado no meio de um
+// workflow. Instâncias em "awaiting_dcc" continuam pausadas aguardando o
+// callback de /accept-dcc.
+func recoverPendingWorkflows(ctx context.Context) {
+	instances, err := store.Instances().ListByStatus(ctx, InstanceStatusPending, InstanceStatusAwaitingDCC)
+	if err != nil {
+		log.Printf("[Orquestrador] Falha ao buscar instâncias pendentes na recuperação: %v", err)
+		return
+	}
+	for _, instance := range instances {
+		if instance.Status == InstanceStatusAwaitingDCC {
+			continue
+		}
+		order, err := store.Orders().Get(ctx, instance.OrderID)
+		if err != nil {
+			log.Printf("[Orquestrador] Pedido %s não encontrado durante recuperação: %v", instance.OrderID, err)
+			continue
+		}
+		log.Printf("[Orquestrador] Retomando workflow pendente para OrderID: %s a partir do passo %d", instance.OrderID, instance.StepIndex)
+		go executeWorkflowSteps(ctx, order, instance)
+	}
+}
+
+// workflowsConfigPath resolve o caminho do arquivo de configuração de
+// workflows a partir de WORKFLOWS_CONFIG_PATH, com "workflows.yaml" como
+// padrão.
+func workflowsConfigPath() string {
+	if path := os.Getenv("WORKFLOWS_CONFIG_PATH"); path != "" {
+		return path
+	}
+	return "workflows.yaml"
+}
+
+// newDefaultStore monta o backend de persistência a partir de variáveis de
+// ambiente: DATABASE_URL aponta para o PostgreSQL; na ausência dela a
+// aplicação cai de volta para o backend em memória (uso local/dev). As
+// definições de workflow vêm sempre de definitions, carregado de arquivo.
+func newDefaultStore(definitions WorkflowDefinitionStore) Store {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		return newMemoryStore(definitions)
+	}
+
+	pgStore, err := newPostgresStore(dsn, definitions)
+	if err != nil {
+		log.Fatalf("[API] Falha ao conectar ao PostgreSQL: %v", err)
+	}
+	return pgStore
+}
+
 func main() {
-	http.HandleFunc("/create-order", createOrder)
-	http.HandleFunc("/accept-dcc", acceptDCCHandler)
+	workflowDefinitions := newConfigWorkflowDefinitionStore(workflowsConfigPath())
+	watchConfigReload(workflowDefinitions)
+
+	store = newDefaultStore(workflowDefinitions)
+	recoverPendingWorkflows(context.Background())
+
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		idempotencyCache = newRedisIdempotencyCache(addr)
+	}
+	startIdempotencySweeper(context.Background(), time.Hour)
+	startWebhookDispatcher(context.Background(), time.Second)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /create-order", withIdempotency(createOrder))
+	mux.HandleFunc("POST /accept-dcc", withIdempotency(acceptDCCHandler))
+	mux.HandleFunc("POST /orders/{id}/refund", refundOrderHandler)
+	mux.HandleFunc("GET /orders/{id}", getOrderHandler)
+	mux.HandleFunc("GET /admin/workflows", adminWorkflowsHandler(workflowDefinitions))
+	mux.HandleFunc("GET /webhook-deliveries", webhookDeliveriesHandler)
+	mux.HandleFunc("POST /webhook-deliveries/{id}/redeliver", redeliverWebhookHandler)
 
 	log.Println("[API] Servidor iniciado na porta 8080")
-	http.ListenAndServe(":8080", nil)
+	http.ListenAndServe(":8080", mux)
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ProviderResult é o retorno de um PBCProvider bem-sucedido.
+type ProviderResult struct {
+	Message string
+	Data    map[string]string
+}
+
+// PBCProvider executa um passo de workflow contra um provedor externo (PBC de
+// pagamento, de DCC, etc). Implementações reais encapsulam o cliente HTTP do
+// provedor; processPayment/proposeDCC viram adaptadores desta interface.
+type PBCProvider interface {
+	Execute(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error)
+}
+
+// ProviderError é o erro estruturado retornado quando um passo falha após
+// esgotar as retentativas, permitindo que o chamador distinga falhas de
+// provedor de erros de programação.
+type ProviderError struct {
+	Service string
+	StepID  string
+	Err     error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("provedor %s falhou no passo %s: %v", e.Service, e.StepID, e.Err)
+}
+
+func (e *ProviderError) Unwrap() error { return e.Err }
+
+// providerRegistry mapeia WorkflowStep.Service para o PBCProvider responsável
+// por executá-lo, permitindo plugar novos provedores sem alterar
+// executeWorkflowSteps.
+var (
+	providerRegistryMu sync.RWMutex
+	providerRegistry   = make(map[string]PBCProvider)
+)
+
+// RegisterProvider associa um PBCProvider ao nome de serviço usado em
+// WorkflowStep.Service (ex.: "PBC_Payment", "PBC_DCC").
+func RegisterProvider(service string, provider PBCProvider) {
+	providerRegistryMu.Lock()
+	defer providerRegistryMu.Unlock()
+	providerRegistry[service] = provider
+}
+
+func providerFor(service string) (PBCProvider, bool) {
+	providerRegistryMu.RLock()
+	defer providerRegistryMu.RUnlock()
+	provider, ok := providerRegistry[service]
+	return provider, ok
+}
+
+// RetryPolicy descreve a política de retentativa com backoff exponencial e
+// jitter usada em torno de cada chamada de provedor.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy é usada quando um WorkflowStep não define a sua própria.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+func (p RetryPolicy) delayFor(attempt int) time.Duration {
+	backoff := float64(p.BaseDelay) * math.Pow(2, float64(attempt))
+	if backoff > float64(p.MaxDelay) {
+		backoff = float64(p.MaxDelay)
+	}
+	jitter := rand.Float64() * backoff * 0.25
+	return time.Duration(backoff + jitter)
+}
+
+// retryWithBackoff executa fn até MaxAttempts vezes, aguardando um backoff
+// exponencial com jitter entre tentativas, e respeitando o cancelamento do
+// ctx.
+func retryWithBackoff(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	var lastErr error
+	for attempt := 0; attempt < policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(policy.delayFor(attempt - 1)):
+			}
+		}
+		lastErr = fn()
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// circuitState representa o estado de um circuitBreaker.
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker implementa o padrão closed/open/half-open por provedor:
+// após FailureThreshold falhas consecutivas o circuito abre e passa a
+// rejeitar chamadas até OpenDuration decorrer; a primeira chamada após esse
+// intervalo é deixada passar em half-open para testar recuperação.
+type circuitBreaker struct {
+	mu               sync.Mutex
+	state            circuitState
+	failures         int
+	FailureThreshold int
+	OpenDuration     time.Duration
+	openedAt         time.Time
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{FailureThreshold: threshold, OpenDuration: openDuration}
+}
+
+// allow reporta se uma chamada pode prosseguir, transicionando open->half-open
+// quando OpenDuration já decorreu.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.OpenDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.state = circuitClosed
+}
+
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.FailureThreshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+var (
+	circuitBreakersMu sync.Mutex
+	circuitBreakers   = make(map[string]*circuitBreaker)
+)
+
+func circuitBreakerFor(service string) *circuitBreaker {
+	circuitBreakersMu.Lock()
+	defer circuitBreakersMu.Unlock()
+	cb, ok := circuitBreakers[service]
+	if !ok {
+		cb = newCircuitBreaker(5, 30*time.Second)
+		circuitBreakers[service] = cb
+	}
+	return cb
+}
+
+// ErrCircuitOpen é retornado quando o circuito de um provedor está aberto e a
+// chamada é rejeitada sem sequer tentar a rede.
+var ErrCircuitOpen = fmt.Errorf("circuito do provedor aberto")
+
+// executeStep resolve o PBCProvider do passo, aplica timeout, circuit breaker
+// e retry-with-backoff, e retorna um *ProviderError estruturado em caso de
+// falha definitiva.
+func executeStep(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error) {
+	provider, ok := providerFor(step.Service)
+	if !ok {
+		return ProviderResult{}, &ProviderError{Service: step.Service, StepID: step.StepID, Err: fmt.Errorf("nenhum provedor registrado")}
+	}
+
+	cb := circuitBreakerFor(step.Service)
+	policy := DefaultRetryPolicy
+
+	var result ProviderResult
+	err := retryWithBackoff(ctx, policy, func() error {
+		if !cb.allow() {
+			return ErrCircuitOpen
+		}
+
+		timeout := step.ProviderTimeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		stepCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		res, err := provider.Execute(stepCtx, step, order)
+		if err != nil {
+			cb.recordFailure()
+			return err
+		}
+		cb.recordSuccess()
+		result = res
+		return nil
+	})
+	if err != nil {
+		return ProviderResult{}, &ProviderError{Service: step.Service, StepID: step.StepID, Err: err}
+	}
+	return result, nil
+}
+
+// paymentProvider é o adaptador de PBC_Payment. Em produção encapsula um
+// cliente HTTP para o gateway de pagamentos (estilo Craftgate/ClearBank);
+// aqui ele preserva o comportamento anterior de processPayment como
+// simulação.
+type paymentProvider struct{}
+
+func (paymentProvider) Execute(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error) {
+	processPayment(order)
+	return ProviderResult{Message: "pagamento processado"}, nil
+}
+
+// dccProvider é o adaptador de PBC_DCC, responsável por consultar um
+// provedor de câmbio (FX) e propor a conversão de moeda ao cliente. A
+// proposta é entregue de forma assíncrona via webhook assinado (ver
+// webhook.go) em vez de esperar o cliente chamar /accept-dcc por polling.
+type dccProvider struct{}
+
+func (dccProvider) Execute(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error) {
+	if err := enqueueDCCProposalWebhook(ctx, order); err != nil {
+		return ProviderResult{}, err
+	}
+	return ProviderResult{Message: "proposta de DCC enfileirada"}, nil
+}
+
+// refundProvider reverte um pagamento já processado, usado tanto como
+// CompensateService de um passo "payment_processing" quanto diretamente pelo
+// workflow sintético de POST /orders/{id}/refund.
+type refundProvider struct{}
+
+func (refundProvider) Execute(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error) {
+	log.Printf("[PBC_Refund] Estornando pagamento para OrderID: %s, valor: %.2f %s", order.OrderID, order.PaymentAmount, order.PaymentCurrency)
+	return ProviderResult{Message: "pagamento estornado"}, nil
+}
+
+// freezeProvider congela o valor do pedido, análogo ao SolveOrderFreeze do
+// dongfeng-pay: usado antes de uma etapa de risco que pode exigir reversão.
+type freezeProvider struct{}
+
+func (freezeProvider) Execute(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error) {
+	log.Printf("[PBC_Freeze] Congelando valor para OrderID: %s, valor: %.2f %s", order.OrderID, order.PaymentAmount, order.PaymentCurrency)
+	return ProviderResult{Message: "valor congelado"}, nil
+}
+
+// unfreezeProvider libera um valor previamente congelado; é o
+// CompensateService natural de um passo "freeze_amount".
+type unfreezeProvider struct{}
+
+func (unfreezeProvider) Execute(ctx context.Context, step WorkflowStep, order Order) (ProviderResult, error) {
+	log.Printf("[PBC_Unfreeze] Liberando valor para OrderID: %s, valor: %.2f %s", order.OrderID, order.PaymentAmount, order.PaymentCurrency)
+	return ProviderResult{Message: "valor liberado"}, nil
+}
+
+func init() {
+	RegisterProvider("PBC_Payment", paymentProvider{})
+	RegisterProvider("PBC_DCC", dccProvider{})
+	RegisterProvider("PBC_Refund", refundProvider{})
+	RegisterProvider("PBC_Freeze", freezeProvider{})
+	RegisterProvider("PBC_Unfreeze", unfreezeProvider{})
+}
+
+func logProviderFailure(order Order, err *ProviderError) {
+	log.Printf("[Orquestrador] Passo %s (%s) falhou definitivamente para OrderID: %s: %v", err.StepID, err.Service, order.OrderID, err)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Status possíveis de um Order ao longo do seu ciclo de vida.
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusCompleted = "completed"
+	OrderStatusFailed    = "failed"
+	OrderStatusRefunded  = "refunded"
+)
+
+// Status de compensação de um StepRecord.
+const (
+	CompensationNone    = ""
+	CompensationDone    = "compensated"
+	CompensationFailed  = "compensation_failed"
+	CompensationSkipped = "skipped_no_action"
+)
+
+// StepRecord é a entrada de histórico de um passo executado (ou compensado)
+// dentro de uma WorkflowInstance, usada pelo endpoint de auditoria
+// GET /orders/{id}.
+type StepRecord struct {
+	StepID             string    `json:"step_id"`
+	Service            string    `json:"service"`
+	Status             string    `json:"status"`
+	StartedAt          time.Time `json:"started_at"`
+	CompletedAt        time.Time `json:"completed_at,omitempty"`
+	CompensationStatus string    `json:"compensation_status,omitempty"`
+	CompensatedAt      time.Time `json:"compensated_at,omitempty"`
+}
+
+// compensate percorre os passos já concluídos de trás para frente a partir de
+// failedIndex-1, invocando o CompensateService de cada um (saga pattern).
+// Isso reverte efeitos colaterais como pagamentos já processados ou valores
+// já congelados quando um passo posterior falha.
+func compensate(ctx context.Context, instance *WorkflowInstance, order Order, failedIndex int) {
+	for i := failedIndex - 1; i >= 0; i-- {
+		record := &instance.StepHistory[i]
+		if record.Status != "completed" {
+			continue
+		}
+
+		step := instance.Workflow.Steps[i]
+		if step.CompensateService == "" {
+			record.CompensationStatus = CompensationSkipped
+			continue
+		}
+
+		log.Printf("[Orquestrador] Compensando passo %s (%s) para OrderID: %s", step.StepID, step.CompensateService, order.OrderID)
+		compensationStep := WorkflowStep{
+			StepID:  step.StepID + "-compensation",
+			Service: step.CompensateService,
+		}
+		if _, err := executeStep(ctx, compensationStep, order); err != nil {
+			record.CompensationStatus = CompensationFailed
+			log.Printf("[Orquestrador] Falha ao compensar passo %s para OrderID: %s: %v", step.StepID, order.OrderID, err)
+			continue
+		}
+		record.CompensationStatus = CompensationDone
+		record.CompensatedAt = time.Now()
+	}
+
+	if err := store.Instances().Save(ctx, instance.InstanceKey, instance); err != nil {
+		log.Printf("[Orquestrador] Falha ao persistir instância após compensação para OrderID: %s: %v", order.OrderID, err)
+	}
+}
+
+// refundWorkflow é o workflow sintético lançado por /orders/{id}/refund
+// contra um pedido já concluído: um único passo "refund" que, se falhar, não
+// tem nada a compensar (é ele próprio a compensação).
+func refundWorkflow() *Workflow {
+	return &Workflow{
+		WorkflowID: "wf-refund",
+		Steps: []WorkflowStep{
+			{StepID: "refund", Service: "PBC_Refund", Status: "pending"},
+		},
+	}
+}
+
+// refundInstanceKey é a chave usada no WorkflowInstanceStore para a
+// instância do workflow de estorno de um pedido, distinta da chave do
+// workflow original (OrderID) para não sobrescrever o histórico de passos
+// que GET /orders/{id} expõe.
+func refundInstanceKey(orderID string) string {
+	return orderID + ":refund"
+}
+
+// refundOrderHandler lança um workflow de compensação contra um pedido já
+// concluído, devolvendo o valor processado.
+func refundOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := r.PathValue("id")
+
+	order, err := store.Orders().Get(ctx, orderID)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if order.Status != OrderStatusCompleted {
+		http.Error(w, "Order is not in a refundable state", http.StatusConflict)
+		return
+	}
+
+	instance := newWorkflowInstance(order.OrderID, refundWorkflow())
+	instance.InstanceKey = refundInstanceKey(order.OrderID)
+	if err := store.Instances().Save(ctx, instance.InstanceKey, instance); err != nil {
+		log.Printf("[Orquestrador] Falha ao persistir instância de estorno para OrderID: %s: %v", order.OrderID, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	go executeWorkflowSteps(context.Background(), order, instance)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"order_id": order.OrderID, "status": "refund_initiated"})
+}
+
+// orderHistoryResponse é o corpo retornado por GET /orders/{id}.
+type orderHistoryResponse struct {
+	Order        Order        `json:"order"`
+	Steps        []StepRecord `json:"steps,omitempty"`
+	Status       string       `json:"workflow_status,omitempty"`
+	RefundSteps  []StepRecord `json:"refund_steps,omitempty"`
+	RefundStatus string       `json:"refund_status,omitempty"`
+}
+
+// getOrderHandler devolve o pedido e o histórico completo de passos
+// (status, timestamps, status de compensação) para auditoria, incluindo o
+// histórico do workflow de estorno (ver refundInstanceKey) quando houver um.
+func getOrderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID := r.PathValue("id")
+
+	order, err := store.Orders().Get(ctx, orderID)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	response := orderHistoryResponse{Order: order}
+	if instance, err := store.Instances().Get(ctx, orderID); err == nil {
+		response.Steps = instance.StepHistory
+		response.Status = instance.Status
+	}
+	if refundInstance, err := store.Instances().Get(ctx, refundInstanceKey(orderID)); err == nil {
+		response.RefundSteps = refundInstance.StepHistory
+		response.RefundStatus = refundInstance.Status
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNotFound é retornado pelos stores quando o registro solicitado não existe.
+var ErrNotFound = errors.New("registro não encontrado")
+
+// OrderStore abstrai a persistência de pedidos, permitindo trocar o backend
+// em memória por um backend durável (ex.: PostgreSQL) sem alterar os handlers.
+type OrderStore interface {
+	// Create persiste um novo pedido e atribui o OrderID gerado.
+	Create(ctx context.Context, order *Order) error
+	Get(ctx context.Context, orderID string) (Order, error)
+	Update(ctx context.Context, order Order) error
+}
+
+// WorkflowDefinitionStore abstrai a leitura das definições de workflow.
+// Isso permite que novos workflows sejam adicionados (ex.: via config ou
+// tabela no banco) sem recompilar a aplicação.
+type WorkflowDefinitionStore interface {
+	Find(ctx context.Context, order Order) (*Workflow, error)
+	// FindByID busca um workflow pelo seu WorkflowID, usado para reconstruir
+	// uma WorkflowInstance persistida (o critério de roteamento original não
+	// está mais disponível nesse ponto, só o ID já resolvido).
+	FindByID(ctx context.Context, workflowID string) (*Workflow, error)
+	All(ctx context.Context) ([]Workflow, error)
+}
+
+// WorkflowInstanceStore abstrai a persistência do progresso de cada
+// instância de workflow (StepIndex, Status), permitindo retomar a execução
+// após um crash do processo.
+type WorkflowInstanceStore interface {
+	Save(ctx context.Context, orderID string, instance *WorkflowInstance) error
+	Get(ctx context.Context, orderID string) (*WorkflowInstance, error)
+	Delete(ctx context.Context, orderID string) error
+	// ListByStatus retorna as instâncias cujo Status está em statuses, usado
+	// pela rotina de recuperação na inicialização.
+	ListByStatus(ctx context.Context, statuses ...string) ([]*WorkflowInstance, error)
+}
+
+// Store agrupa os três repositórios da aplicação e o ponto de extensão para
+// transações, seguindo o mesmo desenho em camadas usado na integração com o
+// paymentsapi: cada transição de passo do workflow deve persistir o pedido e
+// a instância dentro da mesma transação de banco.
+type Store interface {
+	Orders() OrderStore
+	Workflows() WorkflowDefinitionStore
+	Instances() WorkflowInstanceStore
+
+	// WithTransaction executa fn dentro de uma transação; os stores
+	// retornados por Orders/Instances durante fn devem enxergar as
+	// mudanças ainda não commitadas. No backend em memória isso se reduz
+	// a manter o mutex global pela duração de fn.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// memoryStore é a implementação padrão usada em desenvolvimento e testes:
+// mantém os mesmos dados que antes viviam em ordersDB/workflowInstances,
+// mas atrás da interface Store.
+type memoryStore struct {
+	mu sync.Mutex
+
+	orders       map[string]Order
+	instances    map[string]*WorkflowInstance
+	definitions  WorkflowDefinitionStore
+	nextOrderNum int
+}
+
+// newMemoryStore cria um Store em memória que delega a leitura de definições
+// de workflow ao WorkflowDefinitionStore informado (ver config.go).
+func newMemoryStore(definitions WorkflowDefinitionStore) *memoryStore {
+	return &memoryStore{
+		orders:      make(map[string]Order),
+		instances:   make(map[string]*WorkflowInstance),
+		definitions: definitions,
+	}
+}
+
+func (s *memoryStore) Orders() OrderStore                 { return (*memoryOrderStore)(s) }
+func (s *memoryStore) Workflows() WorkflowDefinitionStore { return s.definitions }
+func (s *memoryStore) Instances() WorkflowInstanceStore   { return (*memoryInstanceStore)(s) }
+
+// memTxKey marca, no context.Context, que s.mu já está travado pelo
+// WithTransaction em andamento — espelha o txKey de store_postgres.go, mas
+// aqui evita que os repositórios travem s.mu de novo (sync.Mutex não é
+// reentrante) ao rodar dentro de fn.
+type memTxKey struct{}
+
+func (s *memoryStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(context.WithValue(ctx, memTxKey{}, true))
+}
+
+// lock trava s.mu e retorna a função de unlock correspondente, a menos que
+// ctx já esteja dentro de um WithTransaction — nesse caso o mutex já está
+// travado e lock vira um no-op, para que Create/Get/Update/Save/Delete
+// continuem seguros tanto chamados direto quanto dentro de uma transação.
+func (s *memoryStore) lock(ctx context.Context) (unlock func()) {
+	if locked, _ := ctx.Value(memTxKey{}).(bool); locked {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+type memoryOrderStore memoryStore
+
+func (s *memoryOrderStore) Create(ctx context.Context, order *Order) error {
+	defer (*memoryStore)(s).lock(ctx)()
+	s.nextOrderNum++
+	order.OrderID = fmt.Sprintf("order-%d", s.nextOrderNum)
+	s.orders[order.OrderID] = *order
+	return nil
+}
+
+func (s *memoryOrderStore) Get(ctx context.Context, orderID string) (Order, error) {
+	defer (*memoryStore)(s).lock(ctx)()
+	order, ok := s.orders[orderID]
+	if !ok {
+		return Order{}, ErrNotFound
+	}
+	return order, nil
+}
+
+func (s *memoryOrderStore) Update(ctx context.Context, order Order) error {
+	defer (*memoryStore)(s).lock(ctx)()
+	if _, ok := s.orders[order.OrderID]; !ok {
+		return ErrNotFound
+	}
+	s.orders[order.OrderID] = order
+	return nil
+}
+
+type memoryInstanceStore memoryStore
+
+func (s *memoryInstanceStore) Save(ctx context.Context, orderID string, instance *WorkflowInstance) error {
+	defer (*memoryStore)(s).lock(ctx)()
+	s.instances[orderID] = instance
+	return nil
+}
+
+func (s *memoryInstanceStore) Get(ctx context.Context, orderID string) (*WorkflowInstance, error) {
+	defer (*memoryStore)(s).lock(ctx)()
+	instance, ok := s.instances[orderID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return instance, nil
+}
+
+func (s *memoryInstanceStore) Delete(ctx context.Context, orderID string) error {
+	defer (*memoryStore)(s).lock(ctx)()
+	delete(s.instances, orderID)
+	return nil
+}
+
+func (s *memoryInstanceStore) ListByStatus(ctx context.Context, statuses ...string) ([]*WorkflowInstance, error) {
+	defer (*memoryStore)(s).lock(ctx)()
+	want := make(map[string]bool, len(statuses))
+	for _, st := range statuses {
+		want[st] = true
+	}
+	var out []*WorkflowInstance
+	for _, instance := range s.instances {
+		if want[instance.Status] {
+			out = append(out, instance)
+		}
+	}
+	return out, nil
+}
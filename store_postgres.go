@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// postgresStore é a implementação durável de Store, modelada no mesmo
+// desenho em camadas (repository + transação explícita) usado na integração
+// com o paymentsapi. O schema esperado é:
+//
+//	orders(order_id PK, customer_id, amount, currency, card_brand,
+//	       dcc_accepted, payment_amount, payment_currency, status)
+//	workflow_instances(instance_key PK, order_id, workflow_id, step_index,
+//	                    status, step_history, updated_at)
+//
+// instance_key é usado como chave em vez de order_id porque um mesmo pedido
+// pode ter mais de uma instância (ex.: o workflow principal e, depois, um
+// workflow de estorno — ver WorkflowInstance.InstanceKey e refundInstanceKey
+// em saga.go).
+//
+// As definições de workflow continuam vindo do WorkflowDefinitionStore em
+// memória até o loader de configuração (ver config.go) assumir essa tabela.
+type postgresStore struct {
+	db        *sql.DB
+	workflows WorkflowDefinitionStore
+}
+
+// newPostgresStore abre a conexão e valida o schema com um Ping.
+func newPostgresStore(dsn string, workflows WorkflowDefinitionStore) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("abrindo conexão com postgres: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("verificando conexão com postgres: %w", err)
+	}
+	return &postgresStore{db: db, workflows: workflows}, nil
+}
+
+// txKey guarda a *sql.Tx corrente no context.Context dentro de WithTransaction,
+// para que Orders()/Instances() participem da mesma transação.
+type txKey struct{}
+
+func (s *postgresStore) querier(ctx context.Context) queryExecer {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+// queryExecer é o subconjunto de *sql.DB/*sql.Tx usado pelos repositórios,
+// o que permite que eles operem tanto fora quanto dentro de uma transação.
+type queryExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (s *postgresStore) Orders() OrderStore                 { return (*postgresOrderStore)(s) }
+func (s *postgresStore) Workflows() WorkflowDefinitionStore { return s.workflows }
+func (s *postgresStore) Instances() WorkflowInstanceStore   { return (*postgresInstanceStore)(s) }
+
+func (s *postgresStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("iniciando transação: %w", err)
+	}
+	txCtx := context.WithValue(ctx, txKey{}, tx)
+	if err := fn(txCtx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback falhou: %v)", err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+type postgresOrderStore postgresStore
+
+func (s *postgresOrderStore) Create(ctx context.Context, order *Order) error {
+	q := (*postgresStore)(s).querier(ctx)
+	row := q.QueryRowContext(ctx, `
+		INSERT INTO orders (customer_id, amount, currency, card_brand, payment_amount, payment_currency, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING order_id`,
+		order.CustomerID, order.Amount, order.Currency, order.CardBrand, order.PaymentAmount, order.PaymentCurrency, order.Status)
+	if err := row.Scan(&order.OrderID); err != nil {
+		return fmt.Errorf("inserindo pedido: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresOrderStore) Get(ctx context.Context, orderID string) (Order, error) {
+	q := (*postgresStore)(s).querier(ctx)
+	var order Order
+	row := q.QueryRowContext(ctx, `
+		SELECT order_id, customer_id, amount, currency, card_brand, dcc_accepted, payment_amount, payment_currency, status
+		FROM orders WHERE order_id = $1`, orderID)
+	err := row.Scan(&order.OrderID, &order.CustomerID, &order.Amount, &order.Currency,
+		&order.CardBrand, &order.DCCAccepted, &order.PaymentAmount, &order.PaymentCurrency, &order.Status)
+	if err == sql.ErrNoRows {
+		return Order{}, ErrNotFound
+	}
+	if err != nil {
+		return Order{}, fmt.Errorf("buscando pedido: %w", err)
+	}
+	return order, nil
+}
+
+func (s *postgresOrderStore) Update(ctx context.Context, order Order) error {
+	q := (*postgresStore)(s).querier(ctx)
+	res, err := q.ExecContext(ctx, `
+		UPDATE orders SET dcc_accepted = $2, payment_amount = $3, payment_currency = $4, status = $5
+		WHERE order_id = $1`,
+		order.OrderID, order.DCCAccepted, order.PaymentAmount, order.PaymentCurrency, order.Status)
+	if err != nil {
+		return fmt.Errorf("atualizando pedido: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type postgresInstanceStore postgresStore
+
+func (s *postgresInstanceStore) Save(ctx context.Context, instanceKey string, instance *WorkflowInstance) error {
+	q := (*postgresStore)(s).querier(ctx)
+	stepHistory, err := json.Marshal(instance.StepHistory)
+	if err != nil {
+		return fmt.Errorf("serializando histórico de passos: %w", err)
+	}
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO workflow_instances (instance_key, order_id, workflow_id, step_index, status, step_history, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, now())
+		ON CONFLICT (instance_key) DO UPDATE
+			SET workflow_id  = EXCLUDED.workflow_id,
+			    step_index   = EXCLUDED.step_index,
+			    status       = EXCLUDED.status,
+			    step_history = EXCLUDED.step_history,
+			    updated_at   = now()`,
+		instanceKey, instance.OrderID, instance.Workflow.WorkflowID, instance.StepIndex, instance.Status, stepHistory)
+	if err != nil {
+		return fmt.Errorf("salvando instância de workflow: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresInstanceStore) Get(ctx context.Context, instanceKey string) (*WorkflowInstance, error) {
+	q := (*postgresStore)(s).querier(ctx)
+	var workflowID string
+	var stepHistory []byte
+	instance := &WorkflowInstance{InstanceKey: instanceKey}
+	row := q.QueryRowContext(ctx, `
+		SELECT order_id, workflow_id, step_index, status, step_history FROM workflow_instances WHERE instance_key = $1`, instanceKey)
+	if err := row.Scan(&instance.OrderID, &workflowID, &instance.StepIndex, &instance.Status, &stepHistory); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("buscando instância de workflow: %w", err)
+	}
+	if err := json.Unmarshal(stepHistory, &instance.StepHistory); err != nil {
+		return nil, fmt.Errorf("desserializando histórico de passos: %w", err)
+	}
+	wf, err := s.workflows.FindByID(ctx, workflowID)
+	if err != nil {
+		return nil, err
+	}
+	instance.Workflow = wf
+	return instance, nil
+}
+
+func (s *postgresInstanceStore) Delete(ctx context.Context, instanceKey string) error {
+	q := (*postgresStore)(s).querier(ctx)
+	_, err := q.ExecContext(ctx, `DELETE FROM workflow_instances WHERE instance_key = $1`, instanceKey)
+	if err != nil {
+		return fmt.Errorf("removendo instância de workflow: %w", err)
+	}
+	return nil
+}
+
+func (s *postgresInstanceStore) ListByStatus(ctx context.Context, statuses ...string) ([]*WorkflowInstance, error) {
+	q := (*postgresStore)(s).querier(ctx)
+	rows, err := q.QueryContext(ctx, `
+		SELECT instance_key, order_id, workflow_id, step_index, status, step_history
+		FROM workflow_instances WHERE status = ANY($1)`, pq.Array(statuses))
+	if err != nil {
+		return nil, fmt.Errorf("listando instâncias pendentes: %w", err)
+	}
+	defer rows.Close()
+
+	var out []*WorkflowInstance
+	for rows.Next() {
+		var instanceKey, workflowID string
+		var stepHistory []byte
+		instance := &WorkflowInstance{}
+		if err := rows.Scan(&instanceKey, &instance.OrderID, &workflowID, &instance.StepIndex, &instance.Status, &stepHistory); err != nil {
+			return nil, fmt.Errorf("lendo instância pendente: %w", err)
+		}
+		if err := json.Unmarshal(stepHistory, &instance.StepHistory); err != nil {
+			return nil, fmt.Errorf("desserializando histórico de passos da instância %s: %w", instanceKey, err)
+		}
+		wf, err := s.workflows.FindByID(ctx, workflowID)
+		if err != nil {
+			continue
+		}
+		instance.Workflow = wf
+		instance.InstanceKey = instanceKey
+		out = append(out, instance)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookRetrySchedule define os atrasos entre tentativas de entrega de um
+// webhook, na mesma progressão usada pelo listener do c2ec: 1s, 5s, 30s, 5m,
+// 1h (o último valor se repete até DeadLetterAfter ser atingido).
+var WebhookRetrySchedule = []time.Duration{
+	1 * time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	5 * time.Minute,
+	1 * time.Hour,
+}
+
+// WebhookDeadLetterAfter é o número de tentativas fracassadas após o qual uma
+// entrega vai para a fila de dead-letter e para de ser retentada
+// automaticamente.
+var WebhookDeadLetterAfter = len(WebhookRetrySchedule) + 3
+
+// Status possíveis de uma WebhookDelivery.
+const (
+	WebhookStatusPending    = "pending"
+	WebhookStatusDelivered  = "delivered"
+	WebhookStatusDeadLetter = "dead_letter"
+)
+
+// WebhookDelivery é uma entrega de webhook persistida na tabela outbox: só é
+// removida do fluxo de retentativa quando entregue com sucesso ou quando cai
+// em dead-letter.
+type WebhookDelivery struct {
+	ID            string    `json:"id"`
+	EventID       string    `json:"event_id"`
+	OrderID       string    `json:"order_id"`
+	URL           string    `json:"url"`
+	Payload       []byte    `json:"payload"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	LastError     string    `json:"last_error,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// WebhookOutbox abstrai a persistência das entregas pendentes. A
+// implementação padrão é em memória; um backend durável (mesma família do
+// Store em store.go) pode substituí-la sem alterar o dispatcher.
+type WebhookOutbox interface {
+	Enqueue(ctx context.Context, delivery *WebhookDelivery) error
+	Save(ctx context.Context, delivery *WebhookDelivery) error
+	Get(ctx context.Context, id string) (*WebhookDelivery, error)
+	DueForDelivery(ctx context.Context, now time.Time) ([]*WebhookDelivery, error)
+	List(ctx context.Context) ([]*WebhookDelivery, error)
+}
+
+type memoryWebhookOutbox struct {
+	mu         sync.Mutex
+	deliveries map[string]*WebhookDelivery
+	nextID     int
+}
+
+func newMemoryWebhookOutbox() *memoryWebhookOutbox {
+	return &memoryWebhookOutbox{deliveries: make(map[string]*WebhookDelivery)}
+}
+
+func (o *memoryWebhookOutbox) Enqueue(ctx context.Context, delivery *WebhookDelivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.nextID++
+	delivery.ID = fmt.Sprintf("whd-%d", o.nextID)
+	delivery.EventID = fmt.Sprintf("evt-%d", o.nextID)
+	delivery.Status = WebhookStatusPending
+	delivery.CreatedAt = time.Now()
+	delivery.NextAttemptAt = delivery.CreatedAt
+	o.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (o *memoryWebhookOutbox) Save(ctx context.Context, delivery *WebhookDelivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (o *memoryWebhookOutbox) Get(ctx context.Context, id string) (*WebhookDelivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delivery, ok := o.deliveries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return delivery, nil
+}
+
+func (o *memoryWebhookOutbox) DueForDelivery(ctx context.Context, now time.Time) ([]*WebhookDelivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var due []*WebhookDelivery
+	for _, delivery := range o.deliveries {
+		if delivery.Status == WebhookStatusPending && !now.Before(delivery.NextAttemptAt) {
+			due = append(due, delivery)
+		}
+	}
+	return due, nil
+}
+
+func (o *memoryWebhookOutbox) List(ctx context.Context) ([]*WebhookDelivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]*WebhookDelivery, 0, len(o.deliveries))
+	for _, delivery := range o.deliveries {
+		out = append(out, delivery)
+	}
+	return out, nil
+}
+
+// webhookOutbox é a outbox usada pela aplicação; trocável por um backend
+// durável do mesmo jeito que idempotencyCache.
+var webhookOutbox WebhookOutbox = newMemoryWebhookOutbox()
+
+// webhookSecret assina e verifica os callbacks de DCC. Em produção deve vir
+// de um segredo gerenciado; WEBHOOK_SECRET cobre o caso local/dev.
+func webhookSecret() string {
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		return secret
+	}
+	return "dev-secret-change-me"
+}
+
+// ReplayProtectionWindow é o quanto um X-PBC-Signature pode estar no passado
+// ou no futuro antes de ser rejeitado como possível replay.
+const ReplayProtectionWindow = 5 * time.Minute
+
+// signPayload calcula a assinatura HMAC-SHA256 de body prefixado pelo
+// timestamp, no formato usado pelo cabeçalho X-PBC-Signature.
+func signPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// buildSignatureHeader monta o valor de X-PBC-Signature: "t=<unix>,v1=<hex>".
+func buildSignatureHeader(secret string, body []byte) string {
+	timestamp := time.Now().Unix()
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, signPayload(secret, timestamp, body))
+}
+
+// verifySignatureHeader valida um cabeçalho X-PBC-Signature recebido, checando
+// a assinatura e a janela de proteção contra replay.
+func verifySignatureHeader(secret, header string, body []byte) error {
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			t, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("timestamp inválido em X-PBC-Signature: %w", err)
+			}
+			timestamp = t
+		case "v1":
+			signature = kv[1]
+		}
+	}
+	if timestamp == 0 || signature == "" {
+		return fmt.Errorf("X-PBC-Signature malformado")
+	}
+
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > ReplayProtectionWindow || age < -ReplayProtectionWindow {
+		return fmt.Errorf("X-PBC-Signature fora da janela de proteção contra replay")
+	}
+
+	expected := signPayload(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("assinatura inválida")
+	}
+	return nil
+}
+
+// seenWebhookEventIDs deduplica entregas recebidas mais de uma vez (retry do
+// lado do cliente), dentro da mesma janela de proteção contra replay.
+var (
+	seenWebhookEventsMu sync.Mutex
+	seenWebhookEvents   = make(map[string]time.Time)
+)
+
+func markEventSeen(eventID string) bool {
+	seenWebhookEventsMu.Lock()
+	defer seenWebhookEventsMu.Unlock()
+
+	now := time.Now()
+	for id, seenAt := range seenWebhookEvents {
+		if now.Sub(seenAt) > ReplayProtectionWindow {
+			delete(seenWebhookEvents, id)
+		}
+	}
+	if _, ok := seenWebhookEvents[eventID]; ok {
+		return false
+	}
+	seenWebhookEvents[eventID] = now
+	return true
+}
+
+// dccProposalPayload é o corpo enviado ao callback do cliente quando uma
+// proposta de DCC é feita.
+type dccProposalPayload struct {
+	OrderID           string  `json:"order_id"`
+	OriginalAmount    float64 `json:"original_amount"`
+	OriginalCurrency  string  `json:"original_currency"`
+	ConvertedAmount   float64 `json:"converted_amount"`
+	ConvertedCurrency string  `json:"converted_currency"`
+}
+
+// enqueueDCCProposalWebhook monta a proposta de DCC e a enfileira na outbox
+// para entrega assíncrona ao callback do cliente, em vez de apenas logar a
+// proposta e aguardar o cliente chamar /accept-dcc por polling.
+func enqueueDCCProposalWebhook(ctx context.Context, order Order) error {
+	if order.DCCCallbackURL == "" {
+		// Sem callback configurado: preserva o comportamento anterior de
+		// apenas logar a proposta, útil em ambiente local/dev.
+		proposeDCC(order)
+		return nil
+	}
+
+	convertedAmount := order.PaymentAmount * 0.85
+	payload := dccProposalPayload{
+		OrderID:           order.OrderID,
+		OriginalAmount:    order.PaymentAmount,
+		OriginalCurrency:  order.PaymentCurrency,
+		ConvertedAmount:   convertedAmount,
+		ConvertedCurrency: "BRL",
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("serializando proposta de DCC: %w", err)
+	}
+
+	delivery := &WebhookDelivery{OrderID: order.OrderID, URL: order.DCCCallbackURL, Payload: body}
+	if err := webhookOutbox.Enqueue(ctx, delivery); err != nil {
+		return fmt.Errorf("enfileirando webhook de DCC: %w", err)
+	}
+	log.Printf("[PBC_DCC] Proposta de DCC enfileirada para entrega (delivery %s) para OrderID: %s", delivery.ID, order.OrderID)
+	return nil
+}
+
+var webhookHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// attemptDelivery faz uma tentativa de entrega HTTP do delivery, assinando o
+// corpo com webhookSecret e marcando X-PBC-Event-Id para dedup do lado do
+// cliente.
+func attemptDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-PBC-Event-Id", delivery.EventID)
+	req.Header.Set("X-PBC-Signature", buildSignatureHeader(webhookSecret(), delivery.Payload))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback respondeu com status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// dispatchDueDeliveries busca as entregas prontas para retry/primeira
+// tentativa e as processa, aplicando o backoff de WebhookRetrySchedule e
+// movendo para dead-letter após WebhookDeadLetterAfter tentativas.
+func dispatchDueDeliveries(ctx context.Context) {
+	due, err := webhookOutbox.DueForDelivery(ctx, time.Now())
+	if err != nil {
+		log.Printf("[Webhook] Falha ao buscar entregas pendentes: %v", err)
+		return
+	}
+	for _, delivery := range due {
+		delivery.Attempts++
+		if err := attemptDelivery(ctx, delivery); err != nil {
+			delivery.LastError = err.Error()
+			if delivery.Attempts >= WebhookDeadLetterAfter {
+				delivery.Status = WebhookStatusDeadLetter
+				log.Printf("[Webhook] Delivery %s para OrderID %s foi para dead-letter após %d tentativas: %v", delivery.ID, delivery.OrderID, delivery.Attempts, err)
+			} else {
+				delivery.NextAttemptAt = time.Now().Add(webhookRetryDelay(delivery.Attempts))
+				log.Printf("[Webhook] Delivery %s para OrderID %s falhou (tentativa %d): %v", delivery.ID, delivery.OrderID, delivery.Attempts, err)
+			}
+		} else {
+			delivery.Status = WebhookStatusDelivered
+			delivery.LastError = ""
+			log.Printf("[Webhook] Delivery %s para OrderID %s entregue com sucesso", delivery.ID, delivery.OrderID)
+		}
+		if err := webhookOutbox.Save(ctx, delivery); err != nil {
+			log.Printf("[Webhook] Falha ao persistir delivery %s: %v", delivery.ID, err)
+		}
+	}
+}
+
+// webhookRetryDelay retorna o atraso de WebhookRetrySchedule para a tentativa
+// attempt (1-based), repetindo o último valor além do fim da tabela.
+func webhookRetryDelay(attempt int) time.Duration {
+	index := attempt - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(WebhookRetrySchedule) {
+		index = len(WebhookRetrySchedule) - 1
+	}
+	return WebhookRetrySchedule[index]
+}
+
+// startWebhookDispatcher inicia o loop periódico que processa a outbox de
+// webhooks até ctx ser cancelado.
+func startWebhookDispatcher(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				dispatchDueDeliveries(ctx)
+			}
+		}
+	}()
+}
+
+// webhookDeliveriesHandler lista as entregas da outbox para inspeção
+// operacional em GET /webhook-deliveries.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := webhookOutbox.List(r.Context())
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhookHandler força uma nova tentativa imediata de uma entrega
+// específica, mesmo que esteja em dead-letter.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+
+	delivery, err := webhookOutbox.Get(ctx, id)
+	if err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	delivery.Status = WebhookStatusPending
+	delivery.NextAttemptAt = time.Now()
+	if err := webhookOutbox.Save(ctx, delivery); err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}